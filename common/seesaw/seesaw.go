@@ -0,0 +1,95 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package seesaw contains types that are shared between the Seesaw engine,
+// healthcheck and ECU components.
+package seesaw
+
+import "net"
+
+// AF identifies an address family.
+type AF int
+
+// Address families supported by Seesaw.
+const (
+	IPv4 AF = iota
+	IPv6
+)
+
+// IP wraps a net.IP so that it can be compared with == and used as a map
+// key, while still carrying address-family information.
+type IP struct {
+	ip net.IP
+}
+
+// NewIP returns an IP wrapping ip.
+func NewIP(ip net.IP) IP {
+	return IP{ip: ip}
+}
+
+// IP returns the net.IP this IP wraps.
+func (i IP) IP() net.IP {
+	return i.ip
+}
+
+// AF returns the address family of this IP.
+func (i IP) AF() AF {
+	if i.ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// String returns the string representation of this IP.
+func (i IP) String() string {
+	return i.ip.String()
+}
+
+// HealthcheckMode specifies how a healthcheck reaches a backend.
+type HealthcheckMode int
+
+// Healthcheck modes supported by Seesaw.
+const (
+	// HCModePlain healthchecks the backend directly.
+	HCModePlain HealthcheckMode = iota
+	// HCModeDSR healthchecks the backend via the vserver IP, using a
+	// firewall mark so that the backend's direct server return path is
+	// exercised.
+	HCModeDSR
+	// HCModeTUN healthchecks the backend via the vserver IP, using an IPIP
+	// tunnel so that the backend's tunnelled return path is exercised.
+	HCModeTUN
+)
+
+// HCType identifies the protocol used by a healthcheck.
+type HCType int
+
+// Healthcheck types supported by Seesaw.
+const (
+	HCTypeDNS HCType = iota
+	HCTypeHTTP
+	HCTypeHTTPS
+	HCTypeICMP
+	HCTypeRADIUS
+	HCTypeTCP
+	HCTypeTCPTLS
+	HCTypeUDP
+	// HCTypeUDPPing additionally requires an ICMP ping to succeed before
+	// the UDP send/receive probe is attempted, so that a backend that is
+	// down can be distinguished from one that simply isn't listening on
+	// the probed port.
+	HCTypeUDPPing
+	// HCTypeExec runs an external command to determine backend health.
+	HCTypeExec
+)
@@ -0,0 +1,83 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config contains the engine's resolved view of the cluster
+// configuration.
+package config
+
+import (
+	"time"
+
+	"github.com/google/seesaw/common/seesaw"
+)
+
+// Healthcheck is the resolved configuration for a single healthcheck,
+// as parsed from a vserver's entry in the cluster configuration.
+type Healthcheck struct {
+	Type seesaw.HCType
+	Mode seesaw.HealthcheckMode
+
+	Port uint16
+	// Send is the checker-specific "what to send" value for most
+	// healthcheck types (TCP/UDP/HTTP payload, RADIUS "user:pass:secret",
+	// etc). HCTypeExec repurposes it as the exec command line template
+	// instead, same as the RADIUS case's reuse of it as a colon-delimited
+	// triple; see the HCTypeExec case in engine/healthcheck.go.
+	Send    string
+	Receive string
+	Code    int
+	Method  string
+	Proxy   string
+
+	TLSVerify bool
+
+	Interval time.Duration
+	Timeout  time.Duration
+	Retries  int
+
+	// UDPPingCheck selects the ICMP-then-UDP composite probe for
+	// HCTypeUDP healthchecks, instead of a plain UDP send/receive.
+	UDPPingCheck bool
+
+	// ExecAllowedPaths is the comma-separated allowlist of executable
+	// paths that an HCTypeExec healthcheck for this vserver may run, so
+	// that a compromised config source cannot be used to run arbitrary
+	// binaries.
+	ExecAllowedPaths string
+
+	// ExecUID and ExecGID, if non-zero, are the credentials an
+	// HCTypeExec healthcheck's probe process is run as, so that exec
+	// healthchecks need not run as the engine's own (typically
+	// privileged) user.
+	ExecUID uint32
+	ExecGID uint32
+
+	// GossipDisabled opts this healthcheck out of deduplication and
+	// result-sharing between HA peers, so that both peers always probe
+	// it independently.
+	GossipDisabled bool
+
+	// Window is the number of recent probe outcomes averaged together to
+	// determine graded health. If zero, a package default is used.
+	Window uint32
+
+	// Weight is the destination weight a fully healthy backend ramps up
+	// to. If zero, it defaults to the maximum weight.
+	Weight uint32
+
+	// SlowStart is the duration over which a backend's destination
+	// weight ramps from minimal to Weight after it recovers from being
+	// unhealthy, rather than jumping straight to Weight.
+	SlowStart time.Duration
+}
@@ -24,8 +24,11 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 
 	"github.com/google/seesaw/common/seesaw"
 	"github.com/google/seesaw/engine/config"
@@ -65,31 +68,127 @@ type healthcheckManager struct {
 	next          healthcheck.Id
 	vserverChecks map[string]map[CheckKey]*check // keyed by vserver name
 
-	cfgs    map[healthcheck.Id]*healthcheck.Config
-	checks  map[healthcheck.Id][]*check
-	ids     map[checkerKey]healthcheck.Id
-	enabled bool
-	lock    sync.RWMutex // Guards cfgs, checks, enabled and ids.
+	cfgs       map[healthcheck.Id]*healthcheck.Config
+	checks     map[healthcheck.Id][]*check
+	ids        map[checkerKey]healthcheck.Id
+	gossipInfo map[healthcheck.Id]gossipInfo
+	byKey      map[CheckKey]*checkMeta
+	enabled    bool
+	lock       sync.RWMutex // Guards cfgs, checks, enabled, ids, gossipInfo and byKey.
+
+	gossip  *healthcheckGossip
+	weights *weightTracker
 
 	quit    chan bool
 	stopped chan bool
 	vcc     chan vserverChecks
+
+	// done is closed on shutdown so that auxiliary goroutines (currently
+	// just runGossipSender) can stop, without racing the single-use
+	// quit/stopped handshake used by run.
+	done chan struct{}
 }
 
 // newHealthcheckManager creates a new healthcheckManager.
 func newHealthcheckManager(e *Engine) *healthcheckManager {
-	return &healthcheckManager{
+	h := &healthcheckManager{
 		engine:        e,
 		marks:         make(map[markKey]uint32),
 		markAlloc:     newMarkAllocator(dsrMarkBase, dsrMarkSize),
 		ncc:           e.ncc,
 		next:          healthcheck.Id((uint64(os.Getpid()) & 0xFFFF) << 48),
 		vserverChecks: make(map[string]map[CheckKey]*check),
+		gossip:        newHealthcheckGossip(),
 		quit:          make(chan bool),
+		done:          make(chan struct{}),
 		stopped:       make(chan bool),
 		vcc:           make(chan vserverChecks, 1000),
 		enabled:       true,
 	}
+	h.weights = newWeightTracker(h.notifyWeight)
+	return h
+}
+
+// checkMeta holds what notifyWeight needs in order to publish an
+// out-of-band weight update (e.g. from the weightTracker's slow-start
+// ramp ticker) via the same checkNotification path used for probe-driven
+// updates.
+type checkMeta struct {
+	check       *check
+	description string
+}
+
+// notifyWeight publishes a ramped destination weight computed outside the
+// probe path for the check identified by key, via the same
+// checkNotification/vserver path used for probe-driven weight updates.
+func (h *healthcheckManager) notifyWeight(key CheckKey, weight int) {
+	h.lock.RLock()
+	m := h.byKey[key]
+	h.lock.RUnlock()
+	if m == nil {
+		return
+	}
+
+	note := &checkNotification{
+		key:         key,
+		description: m.description,
+		status:      healthcheck.Status{State: healthcheck.StateHealthy},
+		weight:      weight,
+	}
+	m.check.vserver.queueCheckNotification(note)
+}
+
+// setNodeID sets this node's HA node ID, which is used to elect the
+// authoritative owner (the peer with the lowest node ID) for each
+// deduplicated check that is shared between HA peers. It is called from
+// the HA subsystem whenever this node's HA node ID becomes known or
+// changes, e.g. during HA initialisation.
+func (h *healthcheckManager) setNodeID(id int) {
+	h.gossip.setNodeID(id)
+}
+
+// haSyncSender is the subset of the HA peer connection used to forward
+// gossiped healthcheck results to the peer.
+type haSyncSender interface {
+	SendHealthCheckNotification(*SyncHealthCheckNotification) error
+}
+
+// runGossipSender drains the gossip outbox and forwards each notification
+// to the HA peer over conn, until the healthcheck manager is shut down. It
+// is started as a goroutine by the HA subsystem once conn is established.
+func (h *healthcheckManager) runGossipSender(conn haSyncSender) {
+	for {
+		select {
+		case <-h.done:
+			return
+		case n := <-h.gossip.outboundChannel():
+			if err := conn.SendHealthCheckNotification(n); err != nil {
+				log.Warningf("Failed to gossip healthcheck result for %v to HA peer: %v", n.Key, err)
+			}
+		}
+	}
+}
+
+// startGossip starts forwarding this node's gossiped healthcheck results
+// to the HA peer over conn. It is called from the HA subsystem once a
+// connection to the peer has been established.
+func (e *Engine) startGossip(conn haSyncSender) {
+	go e.healthchecks.runGossipSender(conn)
+}
+
+// HandleSyncHealthCheckNotification is called by the HA subsystem for each
+// SyncHealthCheckNotification received from the peer over the HA
+// connection, and feeds it into the same notification path used for
+// locally-produced results.
+func (e *Engine) HandleSyncHealthCheckNotification(n *SyncHealthCheckNotification) {
+	e.healthchecks.receivePeerNotification(n)
+}
+
+// SetHANodeID is called by the HA subsystem once this node's HA node ID is
+// known, e.g. during HA initialisation, so that the healthcheck gossip can
+// elect an authoritative owner for each shared check.
+func (e *Engine) SetHANodeID(id int) {
+	e.healthchecks.setNodeID(id)
 }
 
 // configs returns the healthcheck Configs for a Seesaw Engine. The returned
@@ -101,7 +200,20 @@ func (h *healthcheckManager) configs() map[healthcheck.Id]*healthcheck.Config {
 	if !h.enabled {
 		return nil
 	}
-	return h.cfgs
+
+	// Checks that are shared with an HA peer are only actively probed by
+	// whichever peer currently owns them; the standby peer keeps the
+	// config built (so marks stay allocated and it can take over once the
+	// owner's claim goes stale, see ownerTTLFactor) but is not handed the
+	// config to probe.
+	active := make(map[healthcheck.Id]*healthcheck.Config, len(h.cfgs))
+	for id, cfg := range h.cfgs {
+		gi := h.gossipInfo[id]
+		if !gi.enabled || h.gossip.isOwner(gi.fingerprint, gi.interval) {
+			active[id] = cfg
+		}
+	}
+	return active
 }
 
 // update updates the healthchecks for a vserver.
@@ -128,8 +240,16 @@ func (h *healthcheckManager) disable() {
 	h.enabled = false
 }
 
+// isEnabled reports whether the healthcheck manager is currently enabled.
+func (h *healthcheckManager) isEnabled() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.enabled
+}
+
 // shutdown requests the healthcheck manager to shutdown.
 func (h *healthcheckManager) shutdown() {
+	close(h.done)
 	h.quit <- true
 	<-h.stopped
 }
@@ -154,6 +274,8 @@ func (h *healthcheckManager) buildMaps() {
 	newIDs := make(map[checkerKey]healthcheck.Id)
 	newCfgs := make(map[healthcheck.Id]*healthcheck.Config)
 	newChecks := make(map[healthcheck.Id][]*check)
+	newGossipInfo := make(map[healthcheck.Id]gossipInfo)
+	newByKey := make(map[CheckKey]*checkMeta, len(allChecks))
 
 	for key, c := range allChecks {
 		cKey := checkerKey{
@@ -174,6 +296,12 @@ func (h *healthcheckManager) buildMaps() {
 			}
 			cfg = newCfg
 		}
+		newGossipInfo[id] = gossipInfo{
+			fingerprint: fingerprint(cKey),
+			enabled:     !c.healthcheck.GossipDisabled,
+			interval:    c.healthcheck.Interval,
+		}
+		newByKey[key] = &checkMeta{check: c, description: cfg.Checker.String()}
 
 		newIDs[cKey] = id
 		newCfgs[id] = cfg
@@ -184,6 +312,8 @@ func (h *healthcheckManager) buildMaps() {
 	h.ids = newIDs
 	h.cfgs = newCfgs
 	h.checks = newChecks
+	h.gossipInfo = newGossipInfo
+	h.byKey = newByKey
 	h.lock.Unlock()
 
 	h.pruneMarks()
@@ -209,6 +339,7 @@ func (h *healthcheckManager) queueHealthState(n *healthcheck.Notification) error
 	enabled := h.enabled
 	cfg := h.cfgs[n.Id]
 	checkList := h.checks[n.Id]
+	gi := h.gossipInfo[n.Id]
 	h.lock.RUnlock()
 
 	if !enabled {
@@ -222,21 +353,98 @@ func (h *healthcheckManager) queueHealthState(n *healthcheck.Notification) error
 	}
 
 	for _, check := range checkList {
+		weight, gen := h.weights.update(check, n.Status)
+
 		note := &checkNotification{
 			key:         check.key,
 			description: cfg.Checker.String(),
 			status:      n.Status,
+			weight:      weight,
 		}
-		check.vserver.queueCheckNotification(note)
+		// Route both the gossip publish and the local vserver
+		// notification through h.weights.publish, using the gen update
+		// just computed it at, so a ramp-ticker tick already in flight
+		// for this key can't supersede this weight locally while a stale
+		// version of it still reaches the HA peer (or vice versa).
+		h.weights.publish(check.key, gen, func() {
+			if gi.enabled {
+				h.gossip.publish(gi.fingerprint, check.key, n.Status, weight)
+				h.gossip.recordDecision("local")
+			}
+			check.vserver.queueCheckNotification(note)
+		})
 	}
 
 	return nil
 }
 
-// SyncHealthCheckNotification stores a status notification for a healthcheck.
+// receivePeerNotification handles a healthcheck result gossiped by the HA
+// peer over the existing HA connection. If this node also owns a check
+// matching the notification's fingerprint, it is accepted and fed into the
+// same notification path as a locally produced result, provided it is
+// fresher than this node's own last local probe by more than the check's
+// interval.
+func (h *healthcheckManager) receivePeerNotification(n *SyncHealthCheckNotification) {
+	h.lock.RLock()
+	var cfg *healthcheck.Config
+	var checkList []*check
+	var interval time.Duration
+	for id, gi := range h.gossipInfo {
+		if gi.fingerprint != checkFingerprint(n.Fingerprint) {
+			continue
+		}
+		interval = gi.interval
+		cfg = h.cfgs[id]
+		checkList = h.checks[id]
+		break
+	}
+	h.lock.RUnlock()
+
+	if cfg == nil || len(checkList) == 0 {
+		log.V(1).Infof("Ignoring peer healthcheck result for unknown fingerprint %x", n.Fingerprint)
+		return
+	}
+
+	h.gossip.notePeer(checkFingerprint(n.Fingerprint), n.NodeID)
+	if !h.gossip.receive(checkFingerprint(n.Fingerprint), n.Epoch, interval) {
+		return
+	}
+	h.gossip.recordDecision("shared")
+
+	for _, check := range checkList {
+		// Mirror the peer's ramp state so that, if this node is promoted
+		// to owner on failover, it resumes the ramp rather than
+		// restarting from scratch.
+		gen := h.weights.mirror(check.key, n.Weight)
+
+		note := &checkNotification{
+			key:         check.key,
+			description: cfg.Checker.String(),
+			status:      n.Status,
+			weight:      n.Weight,
+		}
+		h.weights.publish(check.key, gen, func() {
+			check.vserver.queueCheckNotification(note)
+		})
+	}
+}
+
+// SyncHealthCheckNotification stores a status notification for a
+// healthcheck, gossiped between HA peers that share deduplicated checks.
 type SyncHealthCheckNotification struct {
 	Key CheckKey
 	healthcheck.Status
+
+	// NodeID, Fingerprint and Epoch are used by healthcheckGossip to elect
+	// an authoritative owner per check and to decide whether a gossiped
+	// result is fresh enough to accept.
+	NodeID      int
+	Fingerprint uint64
+	Epoch       int64
+
+	// Weight is the current effective IPVS destination weight, including
+	// any in-progress slow-start ramp, so that the HA peer can mirror it.
+	Weight int
 }
 
 // String returns the string representation for the given notification.
@@ -351,11 +559,38 @@ func (h *healthcheckManager) newConfig(id healthcheck.Id, key CheckKey, hc *conf
 		tcp.TLSVerify = hc.TLSVerify
 		checker = tcp
 	case seesaw.HCTypeUDP:
-		udp := healthcheck.NewUDPChecker(ip, port)
-		target = &udp.Target
-		udp.Send = hc.Send
-		udp.Receive = hc.Receive
-		checker = udp
+		if !hc.UDPPingCheck {
+			udp := healthcheck.NewUDPChecker(ip, port)
+			target = &udp.Target
+			udp.Send = hc.Send
+			udp.Receive = hc.Receive
+			checker = udp
+			break
+		}
+		fallthrough
+	case seesaw.HCTypeUDPPing:
+		// A plain UDP probe cannot tell "port silently dropped" apart from
+		// "host unreachable", so this checker pings the backend first and
+		// only falls through to the UDP send/receive if the ping succeeds.
+		udpPing := healthcheck.NewUDPPingChecker(ip, port)
+		target = &udpPing.Target
+		udpPing.Send = hc.Send
+		udpPing.Receive = hc.Receive
+		udpPing.PingTimeout = hc.Timeout / 2
+		checker = udpPing
+	case seesaw.HCTypeExec:
+		path, args, err := execCommand(hc.Send, host, key.VserverIP.IP(), port, mark)
+		if err != nil {
+			return nil, err
+		}
+		if !execPathAllowed(path, execAllowedPaths(hc.ExecAllowedPaths)) {
+			return nil, fmt.Errorf("exec healthcheck path %q is not in the allowed paths for this vserver", path)
+		}
+		exec := healthcheck.NewExecChecker(path, args...)
+		target = &exec.Target
+		exec.UID = hc.ExecUID
+		exec.GID = hc.ExecGID
+		checker = exec
 	default:
 		return nil, fmt.Errorf("Unknown healthcheck type: %v", hc.Type)
 	}
@@ -372,6 +607,87 @@ func (h *healthcheckManager) newConfig(id healthcheck.Id, key CheckKey, hc *conf
 	return hcc, nil
 }
 
+// execCommand splits an HCTypeExec command line template (hc.Send) into a
+// path and argv, substituting the %BACKEND_IP%, %VSERVER_IP%, %PORT% and
+// %MARK% placeholders with the values resolved for this check.
+func execCommand(template string, backend, vserver net.IP, port, mark int) (string, []string, error) {
+	fields := splitCommandLine(template)
+	if len(fields) == 0 {
+		return "", nil, errors.New("exec healthcheck has no command configured")
+	}
+	replacer := strings.NewReplacer(
+		"%BACKEND_IP%", backend.String(),
+		"%VSERVER_IP%", vserver.String(),
+		"%PORT%", strconv.Itoa(port),
+		"%MARK%", strconv.Itoa(mark),
+	)
+	for i, field := range fields {
+		fields[i] = replacer.Replace(field)
+	}
+	return fields[0], fields[1:], nil
+}
+
+// splitCommandLine tokenizes template on whitespace, except that a
+// double-quoted substring is kept as a single token with its quotes
+// removed. This mirrors the comma-separated execAllowedPaths parsing: both
+// need to let a path contain spaces, so a template whose path is wrapped
+// in double quotes (e.g. `"/opt/my checker" %BACKEND_IP%`) can actually
+// produce a path that matches such an allowed path.
+func splitCommandLine(template string) []string {
+	var fields []string
+	var cur strings.Builder
+	inQuotes, haveToken := false, false
+	flush := func() {
+		if haveToken {
+			fields = append(fields, cur.String())
+			cur.Reset()
+			haveToken = false
+		}
+	}
+	for _, r := range template {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			haveToken = true
+		case unicode.IsSpace(r) && !inQuotes:
+			flush()
+		default:
+			cur.WriteRune(r)
+			haveToken = true
+		}
+	}
+	flush()
+	return fields
+}
+
+// execAllowedPaths parses hc.ExecAllowedPaths, a comma-separated list of
+// absolute executable paths. It is comma- rather than whitespace-separated
+// so that an allowed path containing spaces can still be expressed.
+func execAllowedPaths(raw string) []string {
+	var paths []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// execPathAllowed reports whether path is present in the per-vserver
+// allowlist of executables that HCTypeExec healthchecks may run, so that a
+// compromised config source cannot be used to run arbitrary binaries. path
+// is the already-substituted executable path, so that a template allowed
+// only for one backend/vserver/port combination cannot be used to launch a
+// different executable entirely.
+func execPathAllowed(path string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == path {
+			return true
+		}
+	}
+	return false
+}
+
 // run runs the healthcheck manager and processes incoming vserver checks.
 func (h *healthcheckManager) run() {
 	for {
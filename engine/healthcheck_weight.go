@@ -0,0 +1,315 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+// This file computes graded, slow-starting IPVS destination weights from a
+// backend's recent healthcheck outcomes, in place of a binary
+// healthy/unhealthy transition. Weights are delivered via notify rather
+// than applied directly to IPVS, so that they flow through the same
+// checkNotification/vserver reconciliation path as ordinary health
+// transitions instead of racing the vserver's own IPVS management of the
+// same destination. A probe-driven update and the slow-start ramp ticker
+// can race to publish a weight for the same key from different
+// goroutines; callers must route the actual send through publish (see
+// weightedState.gen) so a stale one can never land after a fresher one.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/seesaw/healthcheck"
+)
+
+const (
+	// defaultWindow is the number of recent probe outcomes averaged by the
+	// EWMA when a healthcheck does not specify hc.Window.
+	defaultWindow = 5
+
+	minWeight = 0
+	maxWeight = 100
+	// rampStartWeight is the destination weight a backend ramps up from
+	// when it first transitions from unhealthy to healthy.
+	rampStartWeight = 1
+
+	// rampTickInterval bounds how often the slow-start ramp re-evaluates
+	// and publishes its weight, independently of probe cadence. Without
+	// this, a healthcheck whose Interval is not shorter than its
+	// SlowStart would never see an intermediate weight: update is only
+	// invoked once per probe, so the ramp would jump straight from
+	// rampStartWeight to the target weight on the next probe.
+	rampTickInterval = time.Second
+)
+
+// weightedState tracks the graded health and slow-start ramp state for a
+// single CheckKey.
+type weightedState struct {
+	ewma   float64 // smoothed fraction of recent healthy outcomes, 0..1
+	weight int     // current effective IPVS destination weight
+
+	ramping   bool // true while slow-starting back up after a recovery
+	rampEnd   time.Time
+	slowStart time.Duration
+	target    int
+
+	// halfOpen is true while a single ramp ticker goroutine is in flight
+	// for this key, deciding (at each tick) whether to keep ramping up or
+	// reset to 0. At most one is ever running per key: starting a ramp
+	// while halfOpen is already true is a no-op, and an unhealthy probe
+	// closes stop to tear down the in-flight ticker before resetting the
+	// weight.
+	halfOpen bool
+	stop     chan struct{}
+
+	// gen counts every time weight is (re)computed, by either update or
+	// the ramp ticker. publish uses it to detect and drop a stale weight
+	// that loses a race to reach notifyMu after a fresher one: otherwise
+	// a ramp tick computed just before update marks the check unhealthy
+	// could still land after the unhealthy notification and briefly
+	// un-fail the backend. notifyMu serializes the two paths' actual
+	// sends so a stale one can be recognised and skipped instead of
+	// interleaving with the fresh one.
+	gen      int
+	notifyMu sync.Mutex
+}
+
+// isHealthy reports whether the smoothed state is currently healthy.
+func (s *weightedState) isHealthy() bool {
+	return s.ewma >= 0.5
+}
+
+// weightTracker computes graded, slow-starting destination weights for
+// healthchecked backends.
+type weightTracker struct {
+	// notify delivers a newly-computed weight for key, via the same
+	// checkNotification/vserver path used for probe-driven updates.
+	notify func(key CheckKey, weight int)
+
+	lock   sync.Mutex
+	states map[CheckKey]*weightedState
+}
+
+// newWeightTracker creates a weightTracker that delivers ramped
+// destination weights via notify.
+func newWeightTracker(notify func(key CheckKey, weight int)) *weightTracker {
+	return &weightTracker{
+		notify: notify,
+		states: make(map[CheckKey]*weightedState),
+	}
+}
+
+// stateFor returns the weightedState for key, creating it if necessary.
+// w.lock must be held.
+func (w *weightTracker) stateFor(key CheckKey) *weightedState {
+	st, ok := w.states[key]
+	if !ok {
+		st = &weightedState{}
+		w.states[key] = st
+	}
+	return st
+}
+
+// update folds a new probe outcome for c into its EWMA, starts or cancels
+// any slow-start ramp as appropriate, and returns the effective weight
+// together with the generation it was computed at. The ramp itself, once
+// started, is advanced by a ticker rather than by further calls to
+// update; see startRampLocked. Callers that go on to send a notification
+// derived from the returned weight must route it through publish, using
+// the returned gen, so that it cannot land after a fresher ramp-ticker
+// notification for the same key.
+func (w *weightTracker) update(c *check, status healthcheck.Status) (weight, gen int) {
+	hc := c.healthcheck
+	window := int(hc.Window)
+	if window <= 0 {
+		window = defaultWindow
+	}
+	target := int(hc.Weight)
+	if target <= 0 {
+		target = maxWeight
+	}
+
+	w.lock.Lock()
+	st := w.stateFor(c.key)
+	wasHealthy := st.isHealthy()
+
+	outcome := 0.0
+	if status.State == healthcheck.StateHealthy {
+		outcome = 1.0
+	}
+	alpha := 2.0 / float64(window+1)
+	st.ewma = alpha*outcome + (1-alpha)*st.ewma
+
+	switch {
+	case !st.isHealthy():
+		st.weight = minWeight
+		w.stopRampLocked(st)
+	case !wasHealthy:
+		// Just recovered: ramp from rampStartWeight up to target over
+		// hc.SlowStart, rather than jumping straight to the full share of
+		// a busy vserver's traffic.
+		st.target = target
+		st.slowStart = hc.SlowStart
+		st.rampEnd = time.Now().Add(hc.SlowStart)
+		st.weight = rampStartWeight
+		if hc.SlowStart > 0 {
+			w.startRampLocked(c.key, st)
+		} else {
+			st.weight = target
+		}
+	case st.ramping:
+		// The ramp ticker owns advancing the weight while ramping; a
+		// probe landing mid-ramp just confirms health.
+	default:
+		st.weight = target
+	}
+	st.gen++
+	weight, gen = st.weight, st.gen
+	w.lock.Unlock()
+
+	return weight, gen
+}
+
+// startRampLocked starts the slow-start ramp ticker for key if one is not
+// already running. w.lock must be held.
+func (w *weightTracker) startRampLocked(key CheckKey, st *weightedState) {
+	if st.halfOpen {
+		return
+	}
+	st.ramping = true
+	st.halfOpen = true
+	st.stop = make(chan struct{})
+	go w.rampTicker(key, st, st.stop)
+}
+
+// stopRampLocked stops any ramp ticker running for st. w.lock must be
+// held.
+func (w *weightTracker) stopRampLocked(st *weightedState) {
+	st.ramping = false
+	if st.halfOpen {
+		close(st.stop)
+		st.halfOpen = false
+	}
+}
+
+// rampTicker periodically recomputes and publishes the slow-start weight
+// for key until the ramp completes or stop is closed. Only one rampTicker
+// is ever in flight per key (st.halfOpen), so it alone decides, tick by
+// tick, whether the ramp keeps advancing.
+func (w *weightTracker) rampTicker(key CheckKey, st *weightedState, stop chan struct{}) {
+	t := time.NewTicker(rampTickInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			w.lock.Lock()
+			if !st.ramping {
+				w.lock.Unlock()
+				return
+			}
+			st.weight = rampedWeight(st.rampEnd, st.slowStart, st.target)
+			done := !time.Now().Before(st.rampEnd)
+			if done {
+				st.weight = st.target
+				st.ramping = false
+				st.halfOpen = false
+			}
+			st.gen++
+			weight, gen := st.weight, st.gen
+			w.lock.Unlock()
+
+			w.publishState(st, gen, func() { w.notify(key, weight) })
+			if done {
+				return
+			}
+		}
+	}
+}
+
+// publish calls send, unless gen has since been superseded by a more
+// recent weight computed for key (by update, mirror or a later ramp
+// tick). It is the entry point for callers outside weightTracker, which
+// only have key, not the *weightedState; see publishState.
+func (w *weightTracker) publish(key CheckKey, gen int, send func()) {
+	w.lock.Lock()
+	st := w.states[key]
+	w.lock.Unlock()
+	if st == nil {
+		send()
+		return
+	}
+	w.publishState(st, gen, send)
+}
+
+// publishState is publish for callers that already hold st, sparing them
+// the extra w.states lookup. notifyMu serializes every call for st, so
+// that whichever of two racing computations is actually the latest always
+// wins: the loser sees st.gen has already moved past its own gen and
+// skips send entirely, rather than the two sends reaching the vserver out
+// of order.
+func (w *weightTracker) publishState(st *weightedState, gen int, send func()) {
+	st.notifyMu.Lock()
+	defer st.notifyMu.Unlock()
+
+	w.lock.Lock()
+	stale := st.gen != gen
+	w.lock.Unlock()
+	if stale {
+		return
+	}
+	send()
+}
+
+// mirror adopts a weight gossiped from the HA peer for key, so that if this
+// node takes over probing on failover it continues the ramp from where the
+// peer left off instead of restarting at rampStartWeight. Since the peer is
+// the authoritative owner while its results are being mirrored, any local
+// ramp ticker for key is stopped. It returns the generation the weight was
+// recorded at; callers sending a notification derived from weight must
+// route it through publish with this gen, the same as update's callers.
+func (w *weightTracker) mirror(key CheckKey, weight int) (gen int) {
+	w.lock.Lock()
+	st := w.stateFor(key)
+	w.stopRampLocked(st)
+	st.weight = weight
+	if weight > 0 {
+		st.ewma = 1
+	}
+	st.gen++
+	gen = st.gen
+	w.lock.Unlock()
+	return gen
+}
+
+// rampedWeight linearly interpolates the destination weight from
+// rampStartWeight to target over the configured slow-start duration.
+func rampedWeight(rampEnd time.Time, slowStart time.Duration, target int) int {
+	if slowStart <= 0 {
+		return target
+	}
+	remaining := time.Until(rampEnd)
+	if remaining <= 0 {
+		return target
+	}
+	elapsed := slowStart - remaining
+	weight := rampStartWeight + int(float64(target-rampStartWeight)*float64(elapsed)/float64(slowStart))
+	if weight < rampStartWeight {
+		weight = rampStartWeight
+	}
+	if weight > target {
+		weight = target
+	}
+	return weight
+}
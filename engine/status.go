@@ -0,0 +1,273 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+// This file contains a status server that exposes Kubernetes-style /livez
+// and /readyz endpoints (plus a legacy /health endpoint) backed by a
+// registry of named, pluggable subchecks.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	ncclient "github.com/google/seesaw/ncc/client"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/golang/glog"
+)
+
+// statusCheck is a single named subcheck. It returns nil when healthy.
+type statusCheck func() error
+
+// statusServer serves /livez, /readyz and /health for the engine.
+type statusServer struct {
+	lock  sync.RWMutex
+	live  map[string]statusCheck
+	ready map[string]statusCheck
+
+	evals *prometheus.CounterVec
+}
+
+// newStatusServer creates a new statusServer with no subchecks registered.
+func newStatusServer() *statusServer {
+	ss := &statusServer{
+		live:  make(map[string]statusCheck),
+		ready: make(map[string]statusCheck),
+		evals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "seesaw",
+			Subsystem: "engine",
+			Name:      "status_subcheck_evaluations_total",
+			Help:      "Number of status subcheck evaluations, by check name and result.",
+		}, []string{"check", "result"}),
+	}
+	prometheus.MustRegister(ss.evals)
+	return ss
+}
+
+// registerReadiness registers a subcheck that contributes to /readyz.
+func (s *statusServer) registerReadiness(name string, check statusCheck) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ready[name] = check
+}
+
+// registerHandlers wires the status endpoints into mux.
+func (s *statusServer) registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/livez", s.handler(s.snapshot(false)))
+	mux.HandleFunc("/readyz", s.handler(s.snapshot(true)))
+	mux.HandleFunc("/health", s.handler(s.snapshot(true)))
+}
+
+// snapshot returns a function producing a point-in-time copy of the
+// liveness or readiness subcheck registry, so that the handler can run the
+// checks without holding the registry lock.
+func (s *statusServer) snapshot(readiness bool) func() map[string]statusCheck {
+	return func() map[string]statusCheck {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		src := s.live
+		if readiness {
+			src = s.ready
+		}
+		checks := make(map[string]statusCheck, len(src))
+		for name, check := range src {
+			checks[name] = check
+		}
+		return checks
+	}
+}
+
+// handler returns an http.HandlerFunc that evaluates the checks produced by
+// checksFn, honouring the "verbose" and repeated "exclude" query params.
+func (s *statusServer) handler(checksFn func() map[string]statusCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		verbose := q.Get("verbose") == "true"
+		excluded := make(map[string]bool)
+		for _, name := range q["exclude"] {
+			excluded[name] = true
+		}
+
+		checks := checksFn()
+		names := make([]string, 0, len(checks))
+		for name := range checks {
+			if !excluded[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		var lines []string
+		healthy := true
+		for _, name := range names {
+			result := "ok"
+			if err := checks[name](); err != nil {
+				result = "failed"
+				healthy = false
+				lines = append(lines, fmt.Sprintf("[-] %s failed: %v", name, err))
+			} else {
+				lines = append(lines, fmt.Sprintf("[+] %s ok", name))
+			}
+			s.evals.WithLabelValues(name, result).Inc()
+		}
+
+		status, statusText := http.StatusOK, "ok"
+		if !healthy {
+			status, statusText = http.StatusServiceUnavailable, "failed"
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if verbose {
+			for _, line := range lines {
+				fmt.Fprintln(w, line)
+			}
+		}
+		fmt.Fprintf(w, "status: %s\n", statusText)
+	}
+}
+
+// run starts serving the status endpoints on addr. It blocks until the
+// server exits and always returns a non-nil error, in the style of
+// http.ListenAndServe.
+func (s *statusServer) run(addr string) error {
+	mux := http.NewServeMux()
+	s.registerHandlers(mux)
+	log.Infof("Status server listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// registerHealthcheckManagerCheck wires the healthcheck manager's enabled
+// state into the readiness check, since readiness must fail whenever
+// healthcheckManager.enabled is false.
+func registerHealthcheckManagerCheck(ss *statusServer, hcm *healthcheckManager) {
+	ss.registerReadiness("healthcheck_manager_enabled", func() error {
+		if !hcm.isEnabled() {
+			return errors.New("healthcheck manager is disabled")
+		}
+		return nil
+	})
+}
+
+// registerConfigSyncCheck registers a readiness check that fails until the
+// engine has completed its initial config sync. The caller is responsible
+// for invoking the returned function once that sync completes.
+func registerConfigSyncCheck(ss *statusServer) (markSynced func()) {
+	var lock sync.Mutex
+	synced := false
+
+	ss.registerReadiness("config_reload", func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !synced {
+			return errors.New("engine is still syncing initial config")
+		}
+		return nil
+	})
+
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		synced = true
+	}
+}
+
+// registerNCCCheck registers a readiness check that fails if the engine
+// cannot reach the ncc component, which mediates all privileged dataplane
+// operations (IPVS, interfaces, routing). It probes this by querying the
+// IPVS service table, since ncc has no cheaper reachability RPC; there is
+// deliberately no separate "ipvs" subcheck, since that would just be this
+// same probe under a second name.
+func registerNCCCheck(ss *statusServer, ncc ncclient.NCC) {
+	ss.registerReadiness("ncc", func() error {
+		if _, err := ncc.IPVSGetServices(); err != nil {
+			return fmt.Errorf("cannot reach ncc: %v", err)
+		}
+		return nil
+	})
+}
+
+// haPeerStatus is the subset of the HA subsystem's state needed by the
+// ha_peer and quorum status subchecks.
+type haPeerStatus interface {
+	// PeerAvailable reports whether this node currently has a live
+	// connection to its HA peer.
+	PeerAvailable() bool
+	// HaveQuorum reports whether this node considers itself part of a
+	// quorum, i.e. safe to remain or become the HA master.
+	HaveQuorum() bool
+}
+
+// registerHAPeerCheck registers a readiness check that fails if this node
+// has lost its connection to its HA peer. This is readiness rather than
+// liveness: losing the peer connection is a transient dependency loss, not
+// a hard fault in this process, and failing liveness on peer loss would
+// have the orchestrator restart the surviving node exactly when its
+// partner is already down.
+func registerHAPeerCheck(ss *statusServer, ha haPeerStatus) {
+	ss.registerReadiness("ha_peer", func() error {
+		if !ha.PeerAvailable() {
+			return errors.New("no connection to HA peer")
+		}
+		return nil
+	})
+}
+
+// registerQuorumCheck registers a readiness check that fails if this node
+// does not have quorum, since it should not be receiving traffic in that
+// state.
+func registerQuorumCheck(ss *statusServer, ha haPeerStatus) {
+	ss.registerReadiness("quorum", func() error {
+		if !ha.HaveQuorum() {
+			return errors.New("node does not have quorum")
+		}
+		return nil
+	})
+}
+
+// newEngineStatusServer builds the engine's status server and registers
+// all of its subchecks against the given healthcheck manager and HA
+// state. The returned markSynced must be invoked once the engine's
+// initial config sync completes.
+//
+// No subcheck is currently registered for liveness: every check here
+// watches an external dependency (HA peer, ncc, config sync), which
+// belongs on readiness, and this snapshot has no internal process-health
+// signal (e.g. a main-loop heartbeat) yet to drive a genuine liveness
+// check. An empty liveness registry always reports healthy, which is the
+// safe default until one exists.
+func newEngineStatusServer(ncc ncclient.NCC, hcm *healthcheckManager, ha haPeerStatus) (ss *statusServer, markSynced func()) {
+	ss = newStatusServer()
+	registerHealthcheckManagerCheck(ss, hcm)
+	registerNCCCheck(ss, ncc)
+	registerHAPeerCheck(ss, ha)
+	registerQuorumCheck(ss, ha)
+	markSynced = registerConfigSyncCheck(ss)
+	return ss, markSynced
+}
+
+// startStatusServer builds and serves the engine's /livez, /readyz and
+// /health endpoints on addr. It is called from Engine.Run once the
+// healthcheck manager and HA state have been initialised, and blocks
+// until the listener fails.
+func (e *Engine) startStatusServer(addr string, hcm *healthcheckManager, ha haPeerStatus) error {
+	ss, markSynced := newEngineStatusServer(e.ncc, hcm, ha)
+	e.markConfigSynced = markSynced
+	return ss.run(addr)
+}
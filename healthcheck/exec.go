@@ -0,0 +1,108 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+// This file implements a healthcheck that determines backend health by
+// running an external command: exit status 0 is healthy, any other exit
+// status (or a timeout) is unhealthy, and the first line of the command's
+// stdout is used as the status Description.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// ExecChecker determines backend health by running an external command.
+type ExecChecker struct {
+	Target
+
+	// Path is the absolute path of the executable to run, and Args its
+	// arguments; both have already had the %BACKEND_IP%, %VSERVER_IP%,
+	// %PORT% and %MARK% placeholders substituted by the caller.
+	Path string
+	Args []string
+
+	// UID and GID, if non-zero, are the credentials the probe process is
+	// run as.
+	UID uint32
+	GID uint32
+}
+
+// NewExecChecker returns a new ExecChecker that runs path with args.
+func NewExecChecker(path string, args ...string) *ExecChecker {
+	return &ExecChecker{Path: path, Args: args}
+}
+
+// String returns the string representation of this healthcheck.
+func (e *ExecChecker) String() string {
+	return fmt.Sprintf("Exec check: %s %s", e.Path, strings.Join(e.Args, " "))
+}
+
+// Check runs the configured command, killing it if it has not exited by
+// timeout. Exit status 0 is healthy; any other exit status, or a timeout,
+// is unhealthy. The Description of the returned Status is the first line
+// of the command's stdout; stderr is logged but does not appear in the
+// Description, so that a noisy or multi-line command doesn't pollute the
+// status reported for the backend.
+func (e *ExecChecker) Check(timeout time.Duration) (*Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	if e.UID != 0 || e.GID != 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: e.UID, Gid: e.GID},
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	runErr := cmd.Run()
+	desc := firstLine(stdout.String())
+	if stderr.Len() > 0 {
+		log.V(1).Infof("Exec healthcheck %s stderr: %s", e.Path, strings.TrimSpace(stderr.String()))
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &Status{
+			State:       StateUnhealthy,
+			Description: fmt.Sprintf("exec healthcheck timed out after %v", timeout),
+		}, nil
+	}
+	if runErr != nil {
+		if desc == "" {
+			desc = runErr.Error()
+		}
+		return &Status{State: StateUnhealthy, Description: desc}, nil
+	}
+	return &Status{State: StateHealthy, Description: desc}, nil
+}
+
+// firstLine returns the first line of s, trimmed of surrounding
+// whitespace.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
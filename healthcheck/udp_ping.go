@@ -0,0 +1,88 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthcheck
+
+// This file implements a composite ICMP-then-UDP healthcheck. A plain UDP
+// probe cannot tell "backend is down" apart from "backend is up but
+// nothing is listening on this port", since both show up as a receive
+// timeout. UDPPingChecker resolves the ambiguity by first confirming the
+// backend answers ICMP echo requests, and only runs the UDP send/receive
+// probe if that succeeds.
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// UDPPingChecker performs an ICMP ping followed by a UDP send/receive
+// probe, reporting unhealthy without attempting the UDP probe if the ping
+// does not succeed.
+type UDPPingChecker struct {
+	Target
+
+	// Send and Receive are the UDP payload and expected response, as per
+	// UDPChecker.
+	Send    string
+	Receive string
+
+	// PingTimeout bounds the initial ICMP probe. If zero, or if it is not
+	// less than the timeout passed to Check, it defaults to half of that
+	// timeout.
+	PingTimeout time.Duration
+
+	ping *PingChecker
+	udp  *UDPChecker
+}
+
+// NewUDPPingChecker returns a new UDPPingChecker for the specified IP
+// address and port.
+func NewUDPPingChecker(ip net.IP, port int) *UDPPingChecker {
+	udp := NewUDPChecker(ip, port)
+	u := &UDPPingChecker{
+		ping: NewPingChecker(ip),
+		udp:  udp,
+	}
+	u.Target = udp.Target
+	return u
+}
+
+// String returns the string representation of this healthcheck.
+func (u *UDPPingChecker) String() string {
+	return fmt.Sprintf("UDP-ping check for %s", u.Target.Host)
+}
+
+// Check pings the backend and, only if that reports healthy, follows up
+// with the UDP send/receive probe for the remainder of timeout.
+func (u *UDPPingChecker) Check(timeout time.Duration) (*Status, error) {
+	pingTimeout := u.PingTimeout
+	if pingTimeout <= 0 || pingTimeout >= timeout {
+		pingTimeout = timeout / 2
+	}
+
+	u.ping.Target = u.Target
+	status, err := u.ping.Check(pingTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("udp-ping: ping probe failed: %v", err)
+	}
+	if status.State != StateHealthy {
+		return status, nil
+	}
+
+	u.udp.Target = u.Target
+	u.udp.Send = u.Send
+	u.udp.Receive = u.Receive
+	return u.udp.Check(timeout - pingTimeout)
+}